@@ -6,9 +6,11 @@ import (
 	"mime"
 	"net/http"
 	"os"
-	"path/filepath"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
 
@@ -70,46 +72,92 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	// Create the file path
-	filePath := filepath.Join(cfg.assetsRoot, fmt.Sprintf("%s.%s", videoID.String(), fileExtension))
-
-	// Create the new file
-	newFile, err := os.Create(filePath)
+	// Get the video's metadata from the database
+	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to create file", err)
+		respondWithError(w, http.StatusInternalServerError, "Unable to get video metadata", err)
+		return
+	}
+
+	// Check if the authenticated user is the video owner
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "You are not the owner of this video", nil)
 		return
 	}
-	defer newFile.Close()
 
-	// Copy the contents from the multipart.File to the new file on disk
-	_, err = io.Copy(newFile, file)
+	// Stage the upload on disk so it can be content-addressed, the same way
+	// handlerUploadVideo dedupes video uploads.
+	tempFile, err := os.CreateTemp("", "tubely-thumbnail-*")
 	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to create temp file", err)
+		return
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	if _, err := io.Copy(tempFile, file); err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Unable to save file", err)
 		return
 	}
 
-	// Get the video's metadata from the database
-	video, err := cfg.db.GetVideo(videoID)
+	hash, size, err := hashFile(tempFile.Name())
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to get video metadata", err)
+		respondWithError(w, http.StatusInternalServerError, "Unable to hash file", err)
 		return
 	}
+	key := fmt.Sprintf("assets/%s.%s", hash, fileExtension)
 
-	// Check if the authenticated user is the video owner
-	if video.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "You are not the owner of this video", nil)
+	exists, err := objectExists(r.Context(), cfg.s3Client, cfg.s3Bucket, key)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to check for existing thumbnail", err)
 		return
 	}
+	if !exists {
+		if _, err := tempFile.Seek(0, io.SeekStart); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Unable to read staged file", err)
+			return
+		}
+		_, err = cfg.s3Client.PutObject(r.Context(), &s3.PutObjectInput{
+			Bucket:      aws.String(cfg.s3Bucket),
+			Key:         aws.String(key),
+			Body:        tempFile,
+			ContentType: aws.String(contentType),
+		})
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Unable to upload thumbnail", err)
+			return
+		}
+	}
 
-	// Update the database with the new thumbnail URL
-	thumbnailURL := fmt.Sprintf("http://localhost:%s/assets/%s.%s", cfg.port, videoID.String(), fileExtension)
-	video.ThumbnailURL = &thumbnailURL
+	// Track the thumbnail as a content-addressed, ref-counted blob the same
+	// way packaged videos are, so it can be reclaimed once nothing points at
+	// it anymore instead of living under assets/ forever. Only the bare key
+	// is persisted on video: handlers sign it into a fetchable URL on demand
+	// via cfg.signVideoURL rather than storing a URL that starts expiring
+	// the moment it's generated.
+	if err := cfg.attachThumbnailBlob(r.Context(), &video, hash, key, size); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to track thumbnail", err)
+		return
+	}
 	err = cfg.db.UpdateVideo(video)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Unable to update video metadata", err)
 		return
 	}
 
-	// Respond with the updated video metadata
-	respondWithJSON(w, http.StatusOK, video)
+	thumbnailURL, err := cfg.signVideoURL(r.Context(), key)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to sign thumbnail URL", err)
+		return
+	}
+
+	// Respond with the updated video metadata plus a freshly signed URL for
+	// the thumbnail, since video.ThumbnailKey alone isn't directly usable.
+	respondWithJSON(w, http.StatusOK, struct {
+		database.Video
+		ThumbnailURL string `json:"thumbnail_url"`
+	}{
+		Video:        video,
+		ThumbnailURL: thumbnailURL,
+	})
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -10,11 +11,7 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
-	"path/filepath"
-	"strings"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/google/uuid"
 )
@@ -196,7 +193,6 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		respondWithError(w, http.StatusInternalServerError, "Could not create temp file", err)
 		return
 	}
-	defer os.Remove(tempFile.Name()) // Clean up original temp file
 	defer tempFile.Close()
 
 	// Copy the uploaded file to the temporary file
@@ -205,14 +201,72 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Get the aspect ratio of the video
-	aspectRatio, err := getVideoAspectRatio(tempFile.Name())
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Could not determine video aspect ratio", err)
+	if err := cfg.processAndPackageVideo(r.Context(), videoID, tempFile.Name()); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not process uploaded video", err)
 		return
 	}
 
-	// Determine the prefix based on the aspect ratio
+	respondWithJSON(w, http.StatusAccepted, video)
+}
+
+// processAndPackageVideo runs the shared pipeline for turning a raw MP4 on
+// local disk into a queued adaptive-bitrate packaging job: detect aspect
+// ratio, faststart it, derive the S3 key prefix, and hand it to the
+// background job runner. If the upload's SHA-256 matches an already-packaged
+// blob, no job is queued: the video is attached to that blob instead. Both
+// handlerUploadVideo (single-shot form upload) and the tus multipart
+// completion path feed into this same pipeline.
+func (cfg *apiConfig) processAndPackageVideo(ctx context.Context, videoID uuid.UUID, sourcePath string) error {
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		return fmt.Errorf("couldn't find video: %v", err)
+	}
+
+	// Every return below either hands sourcePath/processedFilePath/
+	// thumbnailDir off to the background job (which owns their cleanup via
+	// cleanupPaths) or bails out early; this defer is what cleans them up
+	// for every early return, since an ffprobe/ffmpeg failure partway
+	// through is a normal occurrence, not a corner case.
+	var processedFilePath, thumbnailDir string
+	handedOff := false
+	defer func() {
+		if handedOff {
+			return
+		}
+		os.Remove(sourcePath)
+		if processedFilePath != "" {
+			os.Remove(processedFilePath)
+		}
+		if thumbnailDir != "" {
+			os.RemoveAll(thumbnailDir)
+		}
+	}()
+
+	// Content-address the upload before doing any of the expensive work:
+	// if we've already packaged this exact file for another video, just
+	// point this one at the same S3 objects instead of re-running ffmpeg.
+	hash, size, err := hashFile(sourcePath)
+	if err != nil {
+		return fmt.Errorf("could not hash upload: %v", err)
+	}
+	if _, err := cfg.db.GetVideoBlob(hash); err == nil {
+		return cfg.attachToExistingBlob(ctx, video, hash)
+	}
+
+	aspectRatio, err := getVideoAspectRatio(sourcePath)
+	if err != nil {
+		return fmt.Errorf("could not determine video aspect ratio: %v", err)
+	}
+
+	thumbnailDir, err = os.MkdirTemp("", "tubely-thumbnails-*")
+	if err != nil {
+		return fmt.Errorf("could not create thumbnail dir: %v", err)
+	}
+	thumbnails, err := generateThumbnails(sourcePath, thumbnailDir)
+	if err != nil {
+		return fmt.Errorf("could not generate thumbnails: %v", err)
+	}
+
 	var prefix string
 	switch aspectRatio {
 	case "16:9":
@@ -223,55 +277,115 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		prefix = "other"
 	}
 
-	// Process the video for fast start
-	processedFilePath, err := processVideoForFastStart(tempFile.Name())
+	processedFilePath, err = processVideoForFastStart(sourcePath)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Could not process video for fast start", err)
-		return
+		return fmt.Errorf("could not process video for fast start: %v", err)
 	}
-	defer os.Remove(processedFilePath) // Clean up processed temp file
-
-	// Open the processed file for uploading
-	processedFile, err := os.Open(processedFilePath)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Could not open processed file", err)
-		return
-	}
-	defer processedFile.Close()
-
-	// Log file info for debugging
 	if fileInfo, err := os.Stat(processedFilePath); err == nil {
 		fmt.Printf("Processed file size: %d bytes\n", fileInfo.Size())
 	}
 
-	// Generate a unique key with the aspect ratio prefix
-	fileExt := filepath.Ext(handler.Filename)
-	if fileExt == "" {
-		fileExt = ".mp4" // Default to .mp4 if no extension
+	// The S3 key prefix under which every rendition, segment and playlist
+	// for this content-addressed blob will live: <orientation>/<hash>/...
+	// Any other Video row that uploads the same bytes will reuse this
+	// prefix instead of packaging it again.
+	keyPrefix := fmt.Sprintf("%s/%s", prefix, hash)
+
+	// Packaging the adaptive bitrate ladder can take much longer than an
+	// HTTP request should, so hand it off to the background job runner and
+	// let callers respond immediately with a job the client can poll.
+	video.PackagingStatus = string(packagingQueued)
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		return fmt.Errorf("couldn't update video: %v", err)
 	}
-	fileName := strings.ReplaceAll(videoID.String(), "-", "")
-	key := fmt.Sprintf("%s/%s%s", prefix, fileName, fileExt)
 
-	// Upload the processed video file to S3
-	_, err = cfg.s3Client.PutObject(r.Context(), &s3.PutObjectInput{
-		Bucket:      aws.String(cfg.s3Bucket),
-		Key:         aws.String(key),
-		Body:        processedFile,
-		ContentType: aws.String(mediaType),
+	// The job now owns cleanup of every staged path via cleanupPaths;
+	// cancel the defer above so it doesn't race the job for the same files.
+	handedOff = true
+	cfg.packagingJobs.Enqueue(packagingJob{
+		videoID:         videoID,
+		keyPrefix:       keyPrefix,
+		sourcePath:      processedFilePath,
+		thumbnails:      thumbnails,
+		blobHash:        hash,
+		blobSize:        size,
+		blobOrientation: prefix,
+		cleanupPaths:    []string{sourcePath, processedFilePath, thumbnailDir},
 	})
+
+	return nil
+}
+
+// handlerGetPackagingStatus lets clients poll how far along a video's
+// adaptive bitrate packaging job has gotten, since handlerUploadVideo
+// returns before the ffmpeg pipeline has finished.
+func (cfg *apiConfig) handlerGetPackagingStatus(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error uploading file to S3", err)
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
 		return
 	}
 
-	// Construct the S3 URL
-	url := cfg.getObjectURL(key)
-	video.VideoURL = &url
-	err = cfg.db.UpdateVideo(video)
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "Not authorized to view this video", nil)
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, video)
+	status := cfg.packagingJobs.Status(videoID)
+	resp := struct {
+		Status       string `json:"status"`
+		VideoURL     string `json:"video_url,omitempty"`
+		PosterURL    string `json:"poster_url,omitempty"`
+		SpriteURL    string `json:"sprite_url,omitempty"`
+		VTTURL       string `json:"vtt_url,omitempty"`
+		PreviewURL   string `json:"preview_url,omitempty"`
+		ThumbnailURL string `json:"thumbnail_url,omitempty"`
+	}{
+		Status: string(status),
+	}
+
+	if status == packagingReady {
+		if url, err := cfg.signVideoURL(r.Context(), video.VideoKey); err == nil {
+			resp.VideoURL = url
+		}
+		if url, err := cfg.signVideoURL(r.Context(), video.PosterKey); err == nil {
+			resp.PosterURL = url
+		}
+		if url, err := cfg.signVideoURL(r.Context(), video.SpriteKey); err == nil {
+			resp.SpriteURL = url
+		}
+		if url, err := cfg.signVideoURL(r.Context(), video.VTTKey); err == nil {
+			resp.VTTURL = url
+		}
+		if url, err := cfg.signVideoURL(r.Context(), video.PreviewKey); err == nil {
+			resp.PreviewURL = url
+		}
+	}
+
+	// The thumbnail can be a user-uploaded one set independently of
+	// packaging (see handlerUploadThumbnail), so it's signed unconditionally
+	// rather than gated on packagingReady.
+	if video.ThumbnailKey != nil {
+		if url, err := cfg.signVideoURL(r.Context(), *video.ThumbnailKey); err == nil {
+			resp.ThumbnailURL = url
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
 }
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+// tusResumableVersion is the protocol version this server speaks. Every
+// tus response must echo it back so clients can detect a mismatch.
+const tusResumableVersion = "1.0.0"
+
+// minMultipartPartSize is S3's minimum part size for every part except the
+// last one in a multipart upload.
+const minMultipartPartSize = 5 << 20 // 5MB
+
+// tusUpload is the persisted row mapping a tus upload to its S3 multipart
+// upload, so PATCH requests can resume across server restarts and
+// reconnects. Stored in the new "uploads" table.
+type tusUpload struct {
+	ID             uuid.UUID
+	VideoID        uuid.UUID
+	S3Key          string
+	S3UploadID     string
+	ExpectedLength int64
+	Offset         int64
+	Parts          []types.CompletedPart
+	CreatedAt      time.Time
+}
+
+// handlerCreateTusUpload implements the tus "creation" extension: POST
+// establishes a new resumable upload and returns its location. The upload
+// itself is an S3 multipart upload; we just remember the mapping.
+func (cfg *apiConfig) handlerCreateTusUpload(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't find video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "Not authorized to update this video", nil)
+		return
+	}
+
+	uploadLength, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || uploadLength <= 0 {
+		respondWithError(w, http.StatusBadRequest, "Missing or invalid Upload-Length", err)
+		return
+	}
+
+	key := fmt.Sprintf("uploads/%s", videoID.String())
+
+	created, err := cfg.s3Client.CreateMultipartUpload(r.Context(), &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(cfg.s3Bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(parseTusFilenameMetadata(r.Header.Get("Upload-Metadata"))),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't start multipart upload", err)
+		return
+	}
+
+	upload := tusUpload{
+		ID:             uuid.New(),
+		VideoID:        videoID,
+		S3Key:          key,
+		S3UploadID:     aws.ToString(created.UploadId),
+		ExpectedLength: uploadLength,
+		CreatedAt:      time.Now(),
+	}
+	if err := cfg.db.CreateUpload(upload); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't persist upload", err)
+		return
+	}
+
+	w.Header().Set("Tus-Resumable", tusResumableVersion)
+	w.Header().Set("Location", fmt.Sprintf("/api/tus/%s", upload.ID))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handlerHeadTusUpload implements tus "HEAD": clients ask how many bytes
+// the server has already received so they know where to resume from.
+func (cfg *apiConfig) handlerHeadTusUpload(w http.ResponseWriter, r *http.Request) {
+	uploadID, err := uuid.Parse(r.PathValue("uploadID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid upload ID", err)
+		return
+	}
+
+	upload, err := cfg.db.GetUpload(uploadID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Unknown upload", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+	video, err := cfg.db.GetVideo(upload.VideoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't find video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "Not authorized to view this upload", nil)
+		return
+	}
+
+	w.Header().Set("Tus-Resumable", tusResumableVersion)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.ExpectedLength, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// handlerPatchTusUpload implements tus "core": each PATCH appends the next
+// chunk, verified against the offset the client claims to be resuming
+// from. Every chunk, the last one included, becomes one S3 UploadPart call;
+// once the final chunk's part is uploaded, the multipart upload is completed
+// and the object is handed off to the existing faststart/packaging pipeline.
+func (cfg *apiConfig) handlerPatchTusUpload(w http.ResponseWriter, r *http.Request) {
+	uploadID, err := uuid.Parse(r.PathValue("uploadID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid upload ID", err)
+		return
+	}
+
+	upload, err := cfg.db.GetUpload(uploadID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Unknown upload", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+	video, err := cfg.db.GetVideo(upload.VideoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't find video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "Not authorized to update this upload", nil)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != upload.Offset {
+		respondWithError(w, http.StatusConflict, "Upload-Offset does not match current offset", err)
+		return
+	}
+
+	chunk, err := io.ReadAll(r.Body)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read chunk", err)
+		return
+	}
+
+	isFinalChunk := offset+int64(len(chunk)) >= upload.ExpectedLength
+	if !isFinalChunk && len(chunk) < minMultipartPartSize {
+		respondWithError(w, http.StatusBadRequest, "Chunk is smaller than the minimum S3 part size", nil)
+		return
+	}
+
+	partNumber := int32(len(upload.Parts) + 1)
+	part, err := cfg.s3Client.UploadPart(r.Context(), &s3.UploadPartInput{
+		Bucket:     aws.String(cfg.s3Bucket),
+		Key:        aws.String(upload.S3Key),
+		UploadId:   aws.String(upload.S3UploadID),
+		PartNumber: aws.Int32(partNumber),
+		Body:       bytes.NewReader(chunk),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't upload part", err)
+		return
+	}
+
+	upload.Parts = append(upload.Parts, types.CompletedPart{
+		ETag:       part.ETag,
+		PartNumber: aws.Int32(partNumber),
+	})
+	upload.Offset += int64(len(chunk))
+	if err := cfg.db.UpdateUpload(upload); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't persist upload progress", err)
+		return
+	}
+
+	w.Header().Set("Tus-Resumable", tusResumableVersion)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+
+	if upload.Offset < upload.ExpectedLength {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if err := cfg.completeTusUpload(r, upload); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't complete upload", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// completeTusUpload finalizes the S3 multipart upload once every byte has
+// arrived, downloads the assembled object to a temp file, and feeds it
+// into the same faststart + packaging pipeline handlerUploadVideo uses.
+func (cfg *apiConfig) completeTusUpload(r *http.Request, upload tusUpload) error {
+	_, err := cfg.s3Client.CompleteMultipartUpload(r.Context(), &s3.CompleteMultipartUploadInput{
+		Bucket:   aws.String(cfg.s3Bucket),
+		Key:      aws.String(upload.S3Key),
+		UploadId: aws.String(upload.S3UploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{
+			Parts: upload.Parts,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to complete multipart upload: %v", err)
+	}
+	defer cfg.db.DeleteUpload(upload.ID)
+
+	obj, err := cfg.s3Client.GetObject(r.Context(), &s3.GetObjectInput{
+		Bucket: aws.String(cfg.s3Bucket),
+		Key:    aws.String(upload.S3Key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to fetch assembled upload: %v", err)
+	}
+	defer obj.Body.Close()
+
+	tempFile, err := os.CreateTemp("", "tubely-tus-*.mp4")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer tempFile.Close()
+
+	if _, err := io.Copy(tempFile, obj.Body); err != nil {
+		return fmt.Errorf("failed to stage assembled upload: %v", err)
+	}
+
+	if err := cfg.processAndPackageVideo(r.Context(), upload.VideoID, tempFile.Name()); err != nil {
+		return err
+	}
+
+	// The raw assembled object has now been staged to local disk and handed
+	// to the packaging pipeline; it's no longer needed under uploads/ and
+	// would otherwise sit there forever doubling this upload's S3 footprint
+	// on top of the packaged HLS tree.
+	if _, err := cfg.s3Client.DeleteObject(r.Context(), &s3.DeleteObjectInput{
+		Bucket: aws.String(cfg.s3Bucket),
+		Key:    aws.String(upload.S3Key),
+	}); err != nil {
+		fmt.Printf("could not delete assembled tus upload object %s: %v\n", upload.S3Key, err)
+	}
+
+	return nil
+}
+
+// parseTusFilenameMetadata pulls the "filetype" key out of a tus
+// Upload-Metadata header (a comma-separated list of "key base64Value"
+// pairs), falling back to a generic content type when absent or malformed.
+func parseTusFilenameMetadata(header string) string {
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(strings.TrimSpace(pair))
+		if len(fields) != 2 || fields[0] != "filetype" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			continue
+		}
+		return string(decoded)
+	}
+	return "video/mp4"
+}
+
+// tusUploadJanitorInterval is how often the janitor sweeps for abandoned
+// multipart uploads.
+const tusUploadJanitorInterval = time.Hour
+
+// tusUploadMaxAge is how long an incomplete upload is allowed to sit
+// before the janitor aborts it, to avoid paying S3 storage charges for
+// parts that will never be completed.
+const tusUploadMaxAge = 24 * time.Hour
+
+// runTusUploadJanitor periodically aborts multipart uploads that have sat
+// incomplete for longer than tusUploadMaxAge. Intended to run in its own
+// goroutine for the lifetime of the server.
+func (cfg *apiConfig) runTusUploadJanitor() {
+	ticker := time.NewTicker(tusUploadJanitorInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx := context.Background()
+
+		stale, err := cfg.db.ListStaleUploads(time.Now().Add(-tusUploadMaxAge))
+		if err != nil {
+			fmt.Printf("tus janitor: couldn't list stale uploads: %v\n", err)
+			continue
+		}
+
+		for _, upload := range stale {
+			_, err := cfg.s3Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(cfg.s3Bucket),
+				Key:      aws.String(upload.S3Key),
+				UploadId: aws.String(upload.S3UploadID),
+			})
+			if err != nil {
+				fmt.Printf("tus janitor: couldn't abort upload %s: %v\n", upload.ID, err)
+				continue
+			}
+			if err := cfg.db.DeleteUpload(upload.ID); err != nil {
+				fmt.Printf("tus janitor: couldn't delete upload row %s: %v\n", upload.ID, err)
+			}
+		}
+	}
+}
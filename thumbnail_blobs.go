@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// thumbnailBlob is the persisted row backing content-addressed thumbnail
+// storage: multiple Video rows can point at the same uploaded image, so
+// storage is only reclaimed once every referencing Video has moved off it.
+// Stored in the new "thumbnail_blobs" table, the asset-level counterpart to
+// videoBlob.
+type thumbnailBlob struct {
+	Hash     string
+	Size     int64
+	RefCount int
+	Key      string // e.g. "assets/<hash>.jpg"
+}
+
+// attachThumbnailBlob points video at a content-addressed thumbnail blob,
+// creating or incrementing its ref count as needed, and releases whatever
+// thumbnail the video previously had. Sets only the bare key on video, the
+// same way attachToExistingBlob does for packaged video; unlike
+// attachToExistingBlob it does not save video, the caller does.
+func (cfg *apiConfig) attachThumbnailBlob(ctx context.Context, video *database.Video, hash, key string, size int64) error {
+	blob, err := cfg.db.GetThumbnailBlob(hash)
+	if err != nil {
+		blob, err = cfg.db.CreateThumbnailBlob(thumbnailBlob{Hash: hash, Size: size, RefCount: 1, Key: key})
+		if err != nil {
+			return fmt.Errorf("couldn't create thumbnail blob: %v", err)
+		}
+	} else {
+		// IncrementThumbnailBlobRefCount does the read-modify-write
+		// atomically at the DB layer, the same way
+		// IncrementVideoBlobRefCount does, so two concurrent uploads of the
+		// same image can't race each other through a Get-then-Update round
+		// trip and leave the count short.
+		blob, err = cfg.db.IncrementThumbnailBlobRefCount(hash)
+		if err != nil {
+			return fmt.Errorf("couldn't increment thumbnail blob ref count: %v", err)
+		}
+	}
+
+	if err := cfg.releaseThumbnailBlob(ctx, video); err != nil {
+		fmt.Printf("couldn't release previous thumbnail for video %s: %v\n", video.ID, err)
+	}
+
+	video.ThumbnailKey = &blob.Key
+	return nil
+}
+
+// releaseThumbnailBlob decrements the ref count on the blob backing video's
+// current thumbnail, deleting the underlying S3 object only once no other
+// Video row references it anymore. A no-op if video has no thumbnail set.
+func (cfg *apiConfig) releaseThumbnailBlob(ctx context.Context, video *database.Video) error {
+	if video.ThumbnailKey == nil {
+		return nil
+	}
+
+	hash := blobHashFromThumbnailKey(*video.ThumbnailKey)
+	blob, err := cfg.db.DecrementThumbnailBlobRefCount(hash)
+	if err != nil {
+		// Most commonly there's just no tracked blob (e.g. the thumbnail
+		// predates this feature); log so an error after the decrement has
+		// already committed server-side doesn't go unnoticed.
+		fmt.Printf("couldn't decrement thumbnail blob ref count for %s: %v\n", hash, err)
+		return nil
+	}
+	if blob.RefCount > 0 {
+		return nil
+	}
+
+	if _, err := cfg.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(cfg.s3Bucket),
+		Key:    aws.String(blob.Key),
+	}); err != nil {
+		return fmt.Errorf("couldn't delete S3 object: %v", err)
+	}
+	return cfg.db.DeleteThumbnailBlob(blob.Hash)
+}
+
+// blobHashFromThumbnailKey extracts the content hash from a thumbnail key of
+// the form "assets/<hash>.<ext>".
+func blobHashFromThumbnailKey(key string) string {
+	base := strings.TrimPrefix(key, "assets/")
+	if dot := strings.LastIndex(base, "."); dot != -1 {
+		base = base[:dot]
+	}
+	return base
+}
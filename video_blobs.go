@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// videoBlob is the persisted row backing content-addressed video storage:
+// multiple Video rows can point at the same packaged S3 object tree, so
+// storage is only reclaimed once every referencing Video has been deleted.
+// Stored in the new "video_blobs" table.
+type videoBlob struct {
+	Hash        string
+	Size        int64
+	RefCount    int
+	Orientation string
+	KeyPrefix   string // e.g. "landscape/<hash>", shared by every referencing video
+}
+
+// hashFile stream-hashes a file on disk with SHA-256, returning the hex
+// digest and the file's size in bytes.
+func hashFile(path string) (hash string, size int64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, fmt.Errorf("could not open file to hash: %v", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, fmt.Errorf("could not hash file: %v", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// objectExists issues a HeadObject to check whether key is already present
+// in the bucket, so callers can skip a redundant PutObject.
+func objectExists(ctx context.Context, s3Client *s3.Client, bucket, key string) (bool, error) {
+	_, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err == nil {
+		return true, nil
+	}
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
+	return false, fmt.Errorf("could not check for existing object: %v", err)
+}
+
+// attachToExistingBlob links video to an already-packaged content-addressed
+// blob instead of re-running ffmpeg and re-uploading to S3: it bumps the
+// blob's ref count and copies its derived S3 keys onto video.
+func (cfg *apiConfig) attachToExistingBlob(ctx context.Context, video database.Video, hash string) error {
+	// IncrementVideoBlobRefCount does the read-modify-write atomically at
+	// the DB layer (e.g. "UPDATE video_blobs SET ref_count = ref_count + 1
+	// WHERE hash = $1 RETURNING *"), so two concurrent uploads of the same
+	// content can't race each other through a Get-then-Update round trip
+	// and leave the count short.
+	blob, err := cfg.db.IncrementVideoBlobRefCount(hash)
+	if err != nil {
+		return fmt.Errorf("couldn't increment blob ref count: %v", err)
+	}
+
+	video.VideoKey = fmt.Sprintf("%s/master.m3u8", blob.KeyPrefix)
+	video.PackagingStatus = string(packagingReady)
+
+	// As with VideoKey, only the bare keys are persisted here: signing them
+	// into fetchable URLs happens on demand via cfg.signVideoURL, since a
+	// URL signed now would start expiring long before this row is read back.
+	video.PosterKey = fmt.Sprintf("%s/poster.jpg", blob.KeyPrefix)
+	video.SpriteKey = fmt.Sprintf("%s/sprite.jpg", blob.KeyPrefix)
+	video.PreviewKey = fmt.Sprintf("%s/preview.webp", blob.KeyPrefix)
+	video.VTTKey = fmt.Sprintf("%s/thumbnails.vtt", blob.KeyPrefix)
+	if video.ThumbnailKey == nil {
+		video.ThumbnailKey = &video.PosterKey
+	}
+
+	return cfg.db.UpdateVideo(video)
+}
+
+// blobHashFromVideoKey extracts the content hash from a video key of the
+// form "<orientation>/<hash>/master.m3u8".
+func blobHashFromVideoKey(key string) string {
+	parts := strings.Split(key, "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[len(parts)-2]
+}
+
+// deleteObjectTree deletes every object under keyPrefix/, used to reclaim
+// a packaged video's renditions, segments and playlists once its blob's
+// ref count reaches zero.
+func deleteObjectTree(ctx context.Context, s3Client *s3.Client, bucket, keyPrefix string) error {
+	paginator := s3.NewListObjectsV2Paginator(s3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(keyPrefix + "/"),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("could not list objects under %s: %v", keyPrefix, err)
+		}
+		for _, obj := range page.Contents {
+			if _, err := s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    obj.Key,
+			}); err != nil {
+				return fmt.Errorf("could not delete %s: %v", aws.ToString(obj.Key), err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+// thumbnailArtifacts bundles every file generateThumbnails produces so
+// callers can upload them all without having to remember each path.
+type thumbnailArtifacts struct {
+	PosterPath  string // still frame, ~10% into the video
+	SpritePath  string // grid of scrubber hover-preview thumbnails
+	VTTPath     string // WebVTT mapping timestamps to sprite tiles
+	PreviewPath string // short looping animated WebP for hover-play
+}
+
+const (
+	spriteGridCols  = 10
+	spriteGridRows  = 10
+	spriteTileCount = spriteGridCols * spriteGridRows
+	spriteTileWidth = 160
+
+	previewDuration = 3.0 // seconds
+)
+
+// getVideoDuration runs ffprobe and returns the container duration in
+// seconds, used to place the poster frame and space out sprite tiles.
+func getVideoDuration(filePath string) (float64, error) {
+	var stdout bytes.Buffer
+	cmd := exec.Command("ffprobe", "-v", "error", "-show_entries", "format=duration", "-of", "json", filePath)
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return 0, fmt.Errorf("failed to execute ffprobe: %v", err)
+	}
+
+	var response struct {
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &response); err != nil {
+		return 0, fmt.Errorf("failed to unmarshal ffprobe output: %v", err)
+	}
+
+	duration, err := strconv.ParseFloat(response.Format.Duration, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse duration: %v", err)
+	}
+	return duration, nil
+}
+
+// generateThumbnails runs ffmpeg to produce a still poster frame, a sprite
+// sheet with a companion WebVTT file for scrubber hover previews, and a
+// short animated WebP loop for hover-play previews in listing pages. All
+// files are written into outDir.
+func generateThumbnails(filePath, outDir string) (thumbnailArtifacts, error) {
+	duration, err := getVideoDuration(filePath)
+	if err != nil {
+		return thumbnailArtifacts{}, fmt.Errorf("could not determine video duration: %v", err)
+	}
+
+	sourceWidth, sourceHeight, err := getVideoDimensions(filePath)
+	if err != nil {
+		return thumbnailArtifacts{}, fmt.Errorf("could not determine video dimensions: %v", err)
+	}
+	// scale=spriteTileWidth:-1 is width-only and preserves aspect ratio, so
+	// each tile's actual height only matches spriteTileWidth for a square
+	// source; anything else needs the real ratio for accurate hover-preview
+	// cue rectangles. ffmpeg's scale filter rounds to the nearest pixel, so
+	// this has to match with math.Round rather than truncating.
+	spriteTileHeight := int(math.Round(float64(spriteTileWidth) * float64(sourceHeight) / float64(sourceWidth)))
+
+	artifacts := thumbnailArtifacts{
+		PosterPath:  filepath.Join(outDir, "poster.jpg"),
+		SpritePath:  filepath.Join(outDir, "sprite.jpg"),
+		VTTPath:     filepath.Join(outDir, "thumbnails.vtt"),
+		PreviewPath: filepath.Join(outDir, "preview.webp"),
+	}
+
+	posterTime := duration * 0.1
+	if err := runFfmpeg(
+		"-ss", fmt.Sprintf("%.3f", posterTime),
+		"-i", filePath,
+		"-vframes", "1",
+		"-y",
+		artifacts.PosterPath,
+	); err != nil {
+		return thumbnailArtifacts{}, fmt.Errorf("could not extract poster frame: %v", err)
+	}
+
+	spriteInterval := duration / float64(spriteTileCount)
+	if spriteInterval <= 0 {
+		spriteInterval = duration
+	}
+	if err := runFfmpeg(
+		"-i", filePath,
+		"-vf", fmt.Sprintf("fps=1/%.3f,scale=%d:-1,tile=%dx%d", spriteInterval, spriteTileWidth, spriteGridCols, spriteGridRows),
+		"-frames:v", "1",
+		"-y",
+		artifacts.SpritePath,
+	); err != nil {
+		return thumbnailArtifacts{}, fmt.Errorf("could not build sprite sheet: %v", err)
+	}
+
+	if err := writeSpriteVTT(artifacts.VTTPath, "sprite.jpg", duration, spriteInterval, spriteTileHeight); err != nil {
+		return thumbnailArtifacts{}, fmt.Errorf("could not write sprite VTT: %v", err)
+	}
+
+	previewStart := duration * 0.25
+	clipDuration := previewDuration
+	if clipDuration > duration {
+		clipDuration = duration
+	}
+	if err := runFfmpeg(
+		"-ss", fmt.Sprintf("%.3f", previewStart),
+		"-t", fmt.Sprintf("%.3f", clipDuration),
+		"-i", filePath,
+		"-vf", "fps=10,scale=320:-1",
+		"-loop", "0",
+		"-an",
+		"-y",
+		artifacts.PreviewPath,
+	); err != nil {
+		return thumbnailArtifacts{}, fmt.Errorf("could not build animated preview: %v", err)
+	}
+
+	return artifacts, nil
+}
+
+// runFfmpeg invokes ffmpeg with the given arguments, surfacing stderr on
+// failure the same way the rest of the video pipeline does.
+func runFfmpeg(args ...string) error {
+	cmd := exec.Command("ffmpeg", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v, stderr: %s", err, stderr.String())
+	}
+	return nil
+}
+
+// writeSpriteVTT writes a WebVTT file mapping each interval of the source
+// video to the matching tile of the sprite sheet, so a player's scrubber
+// can show a hover preview via "spriteFile#xywh=x,y,w,h".
+func writeSpriteVTT(vttPath, spriteFile string, duration, interval float64, tileHeight int) error {
+	var buf bytes.Buffer
+	buf.WriteString("WEBVTT\n\n")
+
+	tile := 0
+	for start := 0.0; start < duration && tile < spriteTileCount; start += interval {
+		end := start + interval
+		if end > duration {
+			end = duration
+		}
+
+		col := tile % spriteGridCols
+		row := tile / spriteGridCols
+		x := col * spriteTileWidth
+		y := row * tileHeight
+
+		fmt.Fprintf(&buf, "%s --> %s\n%s#xywh=%d,%d,%d,%d\n\n",
+			formatVTTTimestamp(start), formatVTTTimestamp(end), spriteFile, x, y, spriteTileWidth, tileHeight)
+		tile++
+	}
+
+	return os.WriteFile(vttPath, buf.Bytes(), 0o644)
+}
+
+// rewriteVTTSpriteURL rewrites a sprite VTT generated by writeSpriteVTT to
+// reference the sprite sheet by its signed, absolute URL instead of the
+// bare filename it was written with. Under presigned-S3/CloudFront-signed
+// delivery the sprite is only reachable via a full URL with query params,
+// not a relative path next to the VTT, so the cue's "#xywh=..." fragment
+// has to be appended onto that signed URL rather than a bare filename.
+// Returns the path to the rewritten copy.
+func rewriteVTTSpriteURL(vttPath, spriteFile, spriteURL string) (string, error) {
+	content, err := os.ReadFile(vttPath)
+	if err != nil {
+		return "", fmt.Errorf("could not read VTT: %v", err)
+	}
+
+	rewritten := bytes.ReplaceAll(content, []byte(spriteFile+"#"), []byte(spriteURL+"#"))
+
+	outPath := vttPath + ".signed"
+	if err := os.WriteFile(outPath, rewritten, 0o644); err != nil {
+		return "", fmt.Errorf("could not write rewritten VTT: %v", err)
+	}
+	return outPath, nil
+}
+
+// formatVTTTimestamp formats seconds as the HH:MM:SS.mmm timestamp WebVTT
+// cue times require.
+func formatVTTTimestamp(seconds float64) string {
+	whole := int(seconds)
+	hours := whole / 3600
+	minutes := (whole % 3600) / 60
+	secs := whole % 60
+	millis := int((seconds - float64(whole)) * 1000)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", hours, minutes, secs, millis)
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/uuid"
+)
+
+// rendition describes a single entry in the adaptive bitrate ladder.
+type rendition struct {
+	name          string // e.g. "720p", used as the variant subdirectory
+	height        int
+	videoBitrate  string // e.g. "2800k"
+	audioBitrate  string // e.g. "128k"
+	bandwidth     int    // approximate combined bits/sec, for BANDWIDTH attr
+}
+
+// renditionLadderFor returns the set of renditions to produce for a source
+// video of the given height. We never upscale, so a 720p source only gets
+// 720p/480p/360p variants, while a 1080p source also gets a 1080p variant.
+// A source shorter than our lowest rung is packaged at its own height
+// rather than upscaled to it.
+func renditionLadderFor(sourceHeight int) []rendition {
+	ladder := []rendition{
+		{name: "1080p", height: 1080, videoBitrate: "5000k", audioBitrate: "192k", bandwidth: 5300000},
+		{name: "720p", height: 720, videoBitrate: "2800k", audioBitrate: "128k", bandwidth: 3000000},
+		{name: "480p", height: 480, videoBitrate: "1400k", audioBitrate: "128k", bandwidth: 1600000},
+		{name: "360p", height: 360, videoBitrate: "800k", audioBitrate: "96k", bandwidth: 960000},
+	}
+
+	selected := make([]rendition, 0, len(ladder))
+	for _, r := range ladder {
+		if r.height <= sourceHeight {
+			selected = append(selected, r)
+		}
+	}
+	if len(selected) == 0 {
+		// Source is shorter than even our lowest rung; reuse its bitrates
+		// but package at the source's own height instead of upscaling.
+		lowest := ladder[len(ladder)-1]
+		lowest.name = fmt.Sprintf("%dp", sourceHeight)
+		lowest.height = sourceHeight
+		selected = append(selected, lowest)
+	}
+	return selected
+}
+
+// getVideoDimensions runs ffprobe and returns the width and height of the
+// first video stream, for deriving the rendition ladder and each variant's
+// RESOLUTION attribute.
+func getVideoDimensions(filePath string) (width, height int, err error) {
+	var stdout bytes.Buffer
+	cmd := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_streams", filePath)
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return 0, 0, fmt.Errorf("failed to execute ffprobe: %v", err)
+	}
+
+	var response FFProbeResponse
+	if err := json.Unmarshal(stdout.Bytes(), &response); err != nil {
+		return 0, 0, fmt.Errorf("failed to unmarshal ffprobe output: %v", err)
+	}
+	if len(response.Streams) == 0 {
+		return 0, 0, fmt.Errorf("no stream information found")
+	}
+
+	width = response.Streams[0].Width
+	height = response.Streams[0].Height
+	if width <= 0 || height <= 0 {
+		return 0, 0, fmt.Errorf("invalid dimensions: width=%d, height=%d", width, height)
+	}
+	return width, height, nil
+}
+
+// transcodeRendition invokes ffmpeg to package a single rendition as CMAF
+// (fMP4) HLS segments plus its own variant playlist, writing into
+// outDir/<rendition.name>/.
+func transcodeRendition(inputPath, outDir string, r rendition) (variantPlaylist string, err error) {
+	renditionDir := filepath.Join(outDir, r.name)
+	if err := os.MkdirAll(renditionDir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create rendition dir: %v", err)
+	}
+
+	playlistPath := filepath.Join(renditionDir, "stream.m3u8")
+	segmentPattern := filepath.Join(renditionDir, "segment_%03d.m4s")
+	initSegment := filepath.Join(renditionDir, "init.mp4")
+
+	cmd := exec.Command("ffmpeg",
+		"-i", inputPath,
+		"-vf", fmt.Sprintf("scale=-2:%d", r.height),
+		"-c:v", "h264",
+		"-b:v", r.videoBitrate,
+		"-c:a", "aac",
+		"-b:a", r.audioBitrate,
+		"-hls_time", "5",
+		"-hls_playlist_type", "vod",
+		"-hls_segment_type", "fmp4",
+		"-hls_fmp4_init_filename", initSegment,
+		"-hls_segment_filename", segmentPattern,
+		"-f", "hls",
+		"-y",
+		playlistPath,
+	)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("failed to transcode %s rendition: %v, stderr: %s", r.name, err, stderr.String())
+	}
+
+	return playlistPath, nil
+}
+
+// writeMasterPlaylist writes the top-level .m3u8 that references each
+// variant playlist with its BANDWIDTH/RESOLUTION/CODECS attributes.
+// sourceWidth/sourceHeight are the source video's actual dimensions, used to
+// derive each rendition's RESOLUTION at the source's own aspect ratio
+// (transcodeRendition scales width with "scale=-2:height", so a portrait
+// source doesn't actually come out 16:9 just because that's the default
+// assumption).
+func writeMasterPlaylist(outDir string, renditions []rendition, sourceWidth, sourceHeight int) (string, error) {
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n#EXT-X-VERSION:7\n")
+	for _, r := range renditions {
+		// Same arithmetic as ffmpeg's "-2": nearest multiple of 2.
+		width := int(math.Round(float64(r.height)*float64(sourceWidth)/float64(2*sourceHeight))) * 2
+		fmt.Fprintf(&buf, "#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d,CODECS=\"avc1.640028,mp4a.40.2\"\n",
+			r.bandwidth, width, r.height)
+		fmt.Fprintf(&buf, "%s/stream.m3u8\n", r.name)
+	}
+
+	masterPath := filepath.Join(outDir, "master.m3u8")
+	if err := os.WriteFile(masterPath, buf.Bytes(), 0o644); err != nil {
+		return "", fmt.Errorf("failed to write master playlist: %v", err)
+	}
+	return masterPath, nil
+}
+
+// packageAdaptiveBitrate transcodes inputPath into a full rendition ladder
+// plus a master playlist under a fresh temp directory, returning that
+// directory so the caller can upload its full tree to S3.
+func packageAdaptiveBitrate(inputPath string) (outDir string, err error) {
+	sourceWidth, sourceHeight, err := getVideoDimensions(inputPath)
+	if err != nil {
+		return "", fmt.Errorf("could not determine source dimensions: %v", err)
+	}
+
+	outDir, err = os.MkdirTemp("", "tubely-package-*")
+	if err != nil {
+		return "", fmt.Errorf("could not create packaging dir: %v", err)
+	}
+
+	ladder := renditionLadderFor(sourceHeight)
+	for _, r := range ladder {
+		if _, err := transcodeRendition(inputPath, outDir, r); err != nil {
+			os.RemoveAll(outDir)
+			return "", err
+		}
+	}
+
+	if _, err := writeMasterPlaylist(outDir, ladder, sourceWidth, sourceHeight); err != nil {
+		os.RemoveAll(outDir)
+		return "", err
+	}
+
+	return outDir, nil
+}
+
+// uploadPackageTree walks dir and uploads every file to S3 under
+// <keyPrefix>/<relative path>, preserving the HLS directory layout.
+func uploadPackageTree(ctx context.Context, s3Client *s3.Client, bucket, keyPrefix, dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		key := fmt.Sprintf("%s/%s", keyPrefix, filepath.ToSlash(rel))
+
+		// The key is content-addressed by its blob hash, so an identical
+		// upload re-packaged under a race would collide on the same bytes;
+		// skip the redundant PutObject rather than overwrite it.
+		if exists, err := objectExists(ctx, s3Client, bucket, key); err != nil {
+			return err
+		} else if exists {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		contentType := "application/octet-stream"
+		switch filepath.Ext(path) {
+		case ".m3u8":
+			contentType = "application/vnd.apple.mpegurl"
+		case ".m4s", ".mp4":
+			contentType = "video/mp4"
+		}
+
+		_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(bucket),
+			Key:         aws.String(key),
+			Body:        f,
+			ContentType: aws.String(contentType),
+		})
+		return err
+	})
+}
+
+// packagingStatus tracks where a video's adaptive-bitrate packaging job is
+// in its lifecycle. Persisted on the Video row's PackagingStatus so clients
+// can poll it instead of blocking the upload request on a multi-minute
+// ffmpeg run.
+type packagingStatus string
+
+const (
+	packagingQueued     packagingStatus = "queued"
+	packagingProcessing packagingStatus = "processing"
+	packagingReady      packagingStatus = "ready"
+	packagingFailed     packagingStatus = "failed"
+)
+
+// packagingJob is one unit of work for the packaging worker pool: take the
+// faststart-processed source for a video, package it, upload it, and record
+// the outcome.
+type packagingJob struct {
+	videoID      uuid.UUID
+	keyPrefix    string // e.g. "landscape/<hash>", shared by every video with this content
+	sourcePath   string // faststart-processed mp4 on local disk
+	thumbnails   thumbnailArtifacts
+	cleanupPaths []string
+
+	// blobHash/blobSize/blobOrientation describe the content-addressed blob
+	// this job packages, so runJob can record it in the video_blobs table
+	// once packaging succeeds.
+	blobHash        string
+	blobSize        int64
+	blobOrientation string
+}
+
+// packagingJobRunner is a small fixed-size goroutine pool that packages and
+// uploads videos in the background so the upload handler can respond
+// immediately instead of blocking on ffmpeg + S3. Jobs are keyed by video ID,
+// which is what clients poll Status with.
+type packagingJobRunner struct {
+	cfg     *apiConfig
+	jobs    chan packagingJob
+	workers int
+
+	mu       sync.Mutex
+	statuses map[uuid.UUID]packagingStatus
+}
+
+// newPackagingJobRunner starts workers background goroutines pulling off the
+// job queue. The queue is buffered generously (256 jobs) so that enqueuing
+// only blocks the HTTP handler once that many jobs are waiting.
+func newPackagingJobRunner(cfg *apiConfig, workers int) *packagingJobRunner {
+	r := &packagingJobRunner{
+		cfg:      cfg,
+		jobs:     make(chan packagingJob, 256),
+		workers:  workers,
+		statuses: make(map[uuid.UUID]packagingStatus),
+	}
+	for i := 0; i < workers; i++ {
+		go r.worker()
+	}
+	return r
+}
+
+func (r *packagingJobRunner) setStatus(videoID uuid.UUID, status packagingStatus) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.statuses[videoID] = status
+
+	if video, err := r.cfg.db.GetVideo(videoID); err == nil {
+		video.PackagingStatus = string(status)
+		r.cfg.db.UpdateVideo(video)
+	}
+}
+
+// Status returns the last known packaging status for a video: the one this
+// process recorded, else the one persisted on the Video row (e.g. after a
+// restart, or for a video attached to an already-packaged blob), defaulting
+// to "queued" when neither is set.
+func (r *packagingJobRunner) Status(videoID uuid.UUID) packagingStatus {
+	r.mu.Lock()
+	status, ok := r.statuses[videoID]
+	r.mu.Unlock()
+	if ok {
+		return status
+	}
+	if video, err := r.cfg.db.GetVideo(videoID); err == nil && video.PackagingStatus != "" {
+		return packagingStatus(video.PackagingStatus)
+	}
+	return packagingQueued
+}
+
+// Enqueue submits a job. It returns immediately unless all of the queue's
+// buffered slots are taken, in which case it blocks until a worker frees one.
+func (r *packagingJobRunner) Enqueue(job packagingJob) {
+	r.setStatus(job.videoID, packagingQueued)
+	r.jobs <- job
+}
+
+func (r *packagingJobRunner) worker() {
+	for job := range r.jobs {
+		r.runJob(job)
+	}
+}
+
+func (r *packagingJobRunner) runJob(job packagingJob) {
+	defer func() {
+		for _, p := range job.cleanupPaths {
+			os.RemoveAll(p)
+		}
+	}()
+
+	r.setStatus(job.videoID, packagingProcessing)
+
+	outDir, err := packageAdaptiveBitrate(job.sourcePath)
+	if err != nil {
+		fmt.Printf("packaging job for video %s failed: %v\n", job.videoID, err)
+		r.setStatus(job.videoID, packagingFailed)
+		return
+	}
+	defer os.RemoveAll(outDir)
+
+	if err := uploadPackageTree(context.Background(), r.cfg.s3Client, r.cfg.s3Bucket, job.keyPrefix, outDir); err != nil {
+		fmt.Printf("packaging upload for video %s failed: %v\n", job.videoID, err)
+		r.setStatus(job.videoID, packagingFailed)
+		return
+	}
+
+	video, err := r.cfg.db.GetVideo(job.videoID)
+	if err != nil {
+		fmt.Printf("could not load video %s after packaging: %v\n", job.videoID, err)
+		r.setStatus(job.videoID, packagingFailed)
+		return
+	}
+	// Only the bare key is persisted; handlers sign it into a fetchable URL
+	// on demand via cfg.signVideoURL.
+	masterKey := fmt.Sprintf("%s/master.m3u8", job.keyPrefix)
+	video.VideoKey = masterKey
+
+	// Push the poster/sprite/VTT/preview generated alongside this video up
+	// to S3 too. A failure here shouldn't sink an otherwise-ready video, so
+	// it's logged rather than turning the whole job into packagingFailed.
+	// Only the bare keys are persisted below, the same way masterKey is:
+	// handlers sign them into fetchable URLs on demand via cfg.signVideoURL
+	// rather than baking in a URL that expires an hour after packaging.
+	ctx := context.Background()
+	posterKey := fmt.Sprintf("%s/poster.jpg", job.keyPrefix)
+	spriteKey := fmt.Sprintf("%s/sprite.jpg", job.keyPrefix)
+	vttKey := fmt.Sprintf("%s/thumbnails.vtt", job.keyPrefix)
+	previewKey := fmt.Sprintf("%s/preview.webp", job.keyPrefix)
+	thumbnailUploads := []struct {
+		path        string
+		key         string
+		contentType string
+	}{
+		{job.thumbnails.PosterPath, posterKey, "image/jpeg"},
+		{job.thumbnails.SpritePath, spriteKey, "image/jpeg"},
+		{job.thumbnails.VTTPath, vttKey, "text/vtt"},
+		{job.thumbnails.PreviewPath, previewKey, "image/webp"},
+	}
+
+	// The sprite's signed URL is needed transiently here, to embed into the
+	// VTT's cues below, even though only its bare key is persisted on video.
+	var spriteSignedURL string
+	for _, u := range thumbnailUploads {
+		uploadPath := u.path
+		if u.key == vttKey && spriteSignedURL != "" {
+			// The sprite (just above in this slice) has already been
+			// uploaded and signed; embed its URL so the VTT is actually
+			// fetchable once delivery is private, instead of the bare
+			// relative filename it was written with.
+			if rewritten, err := rewriteVTTSpriteURL(u.path, "sprite.jpg", spriteSignedURL); err == nil {
+				uploadPath = rewritten
+			} else {
+				fmt.Printf("could not embed signed sprite URL into VTT for video %s: %v\n", job.videoID, err)
+			}
+		}
+
+		if err := r.uploadThumbnailFile(ctx, uploadPath, u.key, u.contentType); err != nil {
+			fmt.Printf("thumbnail upload for video %s failed: %v\n", job.videoID, err)
+			continue
+		}
+
+		if u.key == spriteKey {
+			if signed, err := r.cfg.signVideoURL(ctx, u.key); err == nil {
+				spriteSignedURL = signed
+			} else {
+				fmt.Printf("could not sign sprite URL for video %s: %v\n", job.videoID, err)
+			}
+		}
+	}
+
+	video.PosterKey = posterKey
+	video.SpriteKey = spriteKey
+	video.VTTKey = vttKey
+	video.PreviewKey = previewKey
+	if video.ThumbnailKey == nil {
+		video.ThumbnailKey = &video.PosterKey
+	}
+
+	if err := r.cfg.db.UpdateVideo(video); err != nil {
+		fmt.Printf("could not update video %s after packaging: %v\n", job.videoID, err)
+		r.setStatus(job.videoID, packagingFailed)
+		return
+	}
+
+	blob := videoBlob{
+		Hash:        job.blobHash,
+		Size:        job.blobSize,
+		RefCount:    1,
+		Orientation: job.blobOrientation,
+		KeyPrefix:   job.keyPrefix,
+	}
+	if err := r.cfg.db.CreateVideoBlob(blob); err != nil {
+		fmt.Printf("could not record video blob for video %s: %v\n", job.videoID, err)
+	}
+
+	r.setStatus(job.videoID, packagingReady)
+}
+
+// uploadThumbnailFile uploads a single generated thumbnail artifact to S3,
+// skipping the PutObject if an identical key is already there (another
+// video with the same content was packaged first).
+func (r *packagingJobRunner) uploadThumbnailFile(ctx context.Context, path, key, contentType string) error {
+	exists, err := objectExists(ctx, r.cfg.s3Client, r.cfg.s3Bucket, key)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not open %s: %v", path, err)
+	}
+	defer f.Close()
+
+	_, err = r.cfg.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(r.cfg.s3Bucket),
+		Key:         aws.String(key),
+		Body:        f,
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return fmt.Errorf("could not upload %s: %v", key, err)
+	}
+	return nil
+}
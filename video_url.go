@@ -0,0 +1,22 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// signVideoURL resolves a stored S3 key into a fresh, short-lived URL using
+// whichever storage.Provider this server was configured with (public
+// bucket, presigned S3, or signed CloudFront). Video records only ever
+// persist the bare S3 key; the signed URL is generated on demand each time
+// a video is served back to a client.
+func (cfg *apiConfig) signVideoURL(ctx context.Context, key string) (string, error) {
+	if key == "" {
+		return "", nil
+	}
+	url, err := cfg.storage.SignedURL(ctx, key)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign URL for %s: %v", key, err)
+	}
+	return url, nil
+}